@@ -0,0 +1,351 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// DomainRule classifies the queried domain itself via regex, for rules that
+// don't reduce to a suffix match (e.g. a catch-all wildcard pattern).
+type DomainRule struct {
+	Name    string
+	Pattern *regexp.Regexp
+}
+
+// domainEntry is a single blocklist line, a domain mapped to the
+// classification it should produce.
+type domainEntry struct {
+	domain string
+	name   string
+}
+
+// cidrRuleEntry is a single CIDR rule parsed from the rules file.
+type cidrRuleEntry struct {
+	cidr *net.IPNet
+	name string
+}
+
+// Classifier evaluates a response's answer section against user-supplied
+// rules and remote blocklists, so a scan can flag NXDOMAIN rewrites,
+// ad-filter sinkholes, and wildcard captive portals inline instead of
+// through post-processing SQL.
+type Classifier struct {
+	domainRules []DomainRule
+	domains     *domainTrie
+	cidrs       *cidrTrie
+}
+
+// NewClassifier builds a Classifier from an optional rules file (regex and
+// CIDR rules, one per line) and any number of remote pihole-style
+// blocklists. Blocklists are fetched once here, at startup, and compiled
+// into a domain-suffix trie, and the rules file's CIDR rules into a CIDR
+// trie, so per-answer lookups stay cheap regardless of list size.
+func NewClassifier(rulesPath string, blocklistURLs []string) (*Classifier, error) {
+	c := &Classifier{domains: newDomainTrie(), cidrs: newCIDRTrie()}
+
+	if rulesPath != "" {
+		domainRules, cidrRules, err := loadRulesFile(rulesPath)
+		if err != nil {
+			return nil, fmt.Errorf("loading classify rules: %w", err)
+		}
+		c.domainRules = domainRules
+		for _, r := range cidrRules {
+			c.cidrs.insert(r.cidr, r.name)
+		}
+	}
+
+	for _, u := range blocklistURLs {
+		entries, err := fetchBlocklist(u)
+		if err != nil {
+			return nil, fmt.Errorf("fetching blocklist %q: %w", u, err)
+		}
+		for _, e := range entries {
+			c.domains.insert(e.domain, e.name)
+		}
+	}
+
+	return c, nil
+}
+
+// Classify returns the first matching rule's name for a response to
+// queryDomain, or a classification derived from the response's RCODE
+// ("clean" for NOERROR) when nothing matches.
+func (c *Classifier) Classify(queryDomain string, resp *dns.Msg) string {
+	for _, rule := range c.domainRules {
+		if rule.Pattern.MatchString(queryDomain) {
+			return rule.Name
+		}
+	}
+
+	if name := c.domains.lookup(queryDomain); name != "" {
+		return name
+	}
+
+	for _, rr := range resp.Answer {
+		if name := c.domains.lookup(rr.Header().Name); name != "" {
+			return name
+		}
+		if ip := answerIP(rr); ip != nil {
+			if name := c.cidrs.lookup(ip); name != "" {
+				return name
+			}
+		}
+	}
+
+	if resp.Rcode != dns.RcodeSuccess {
+		return strings.ToLower(dns.RcodeToString[resp.Rcode])
+	}
+	return "clean"
+}
+
+func answerIP(rr dns.RR) net.IP {
+	switch r := rr.(type) {
+	case *dns.A:
+		return r.A
+	case *dns.AAAA:
+		return r.AAAA
+	default:
+		return nil
+	}
+}
+
+// loadRulesFile reads user-supplied classify rules, one per line:
+//
+//	domain <regexp> <name>
+//	cidr   <CIDR> <name>
+//
+// Blank lines and lines starting with # are skipped.
+func loadRulesFile(path string) ([]DomainRule, []cidrRuleEntry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+
+	var (
+		domainRules []DomainRule
+		cidrRules   []cidrRuleEntry
+	)
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			return nil, nil, fmt.Errorf("invalid rule %q: want \"domain|cidr <pattern> <name>\"", line)
+		}
+
+		kind, pattern, name := fields[0], fields[1], fields[2]
+		switch kind {
+		case "domain":
+			re, err := regexp.Compile(pattern)
+			if err != nil {
+				return nil, nil, fmt.Errorf("invalid regex %q: %w", pattern, err)
+			}
+			domainRules = append(domainRules, DomainRule{Name: name, Pattern: re})
+		case "cidr":
+			_, cidr, err := net.ParseCIDR(pattern)
+			if err != nil {
+				return nil, nil, fmt.Errorf("invalid CIDR %q: %w", pattern, err)
+			}
+			cidrRules = append(cidrRules, cidrRuleEntry{cidr: cidr, name: name})
+		default:
+			return nil, nil, fmt.Errorf("unknown rule kind %q (want domain or cidr)", kind)
+		}
+	}
+
+	return domainRules, cidrRules, scanner.Err()
+}
+
+// fetchBlocklist retrieves a pihole-style blocklist (hosts-file or
+// plain-domain-per-line format) and returns its entries, each classified as
+// "sinkhole:<label>" where label is derived from the URL.
+func fetchBlocklist(rawURL string) ([]domainEntry, error) {
+	resp, err := http.Get(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("status %s", resp.Status)
+	}
+
+	name := "sinkhole:" + blocklistLabel(rawURL)
+
+	var entries []domainEntry
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		domain := parseBlocklistLine(scanner.Text())
+		if domain == "" {
+			continue
+		}
+		entries = append(entries, domainEntry{domain: domain, name: name})
+	}
+
+	return entries, scanner.Err()
+}
+
+// parseBlocklistLine extracts a domain from a hosts-file line
+// ("0.0.0.0 ads.example.com") or a plain domain-per-line blocklist,
+// ignoring comments and blank lines.
+func parseBlocklistLine(line string) string {
+	line = strings.TrimSpace(line)
+	if line == "" || strings.HasPrefix(line, "#") {
+		return ""
+	}
+	fields := strings.Fields(line)
+	switch len(fields) {
+	case 1:
+		return fields[0]
+	case 2:
+		return fields[1]
+	default:
+		return ""
+	}
+}
+
+func blocklistLabel(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Host == "" {
+		return rawURL
+	}
+	base := strings.TrimSuffix(path.Base(u.Path), path.Ext(u.Path))
+	if base == "" || base == "." || base == "/" {
+		return u.Host
+	}
+	return base
+}
+
+// domainTrie is a suffix trie over reversed domain labels, used for O(depth)
+// blocklist suffix lookups regardless of list size.
+type domainTrie struct {
+	children map[string]*domainTrie
+	name     string
+}
+
+func newDomainTrie() *domainTrie {
+	return &domainTrie{children: make(map[string]*domainTrie)}
+}
+
+func (t *domainTrie) insert(domain, name string) {
+	node := t
+	for _, label := range reverseLabels(domain) {
+		child, ok := node.children[label]
+		if !ok {
+			child = newDomainTrie()
+			node.children[label] = child
+		}
+		node = child
+	}
+	node.name = name
+}
+
+// lookup returns the classification of the longest blocked suffix of domain,
+// or "" if nothing matches.
+func (t *domainTrie) lookup(domain string) string {
+	node := t
+	match := ""
+	for _, label := range reverseLabels(domain) {
+		child, ok := node.children[label]
+		if !ok {
+			break
+		}
+		node = child
+		if node.name != "" {
+			match = node.name
+		}
+	}
+	return match
+}
+
+func reverseLabels(domain string) []string {
+	labels := strings.Split(strings.TrimSuffix(strings.ToLower(domain), "."), ".")
+	for i, j := 0, len(labels)-1; i < j; i, j = i+1, j-1 {
+		labels[i], labels[j] = labels[j], labels[i]
+	}
+	return labels
+}
+
+// cidrTrie is a pair of binary tries over IP address bits, one per address
+// family, used for longest-prefix lookups of answer IPs against CIDR rules.
+// Keeping v4 and v6 separate avoids a v4 prefix and a v6 prefix with
+// coincidentally matching leading bits classifying each other's addresses.
+type cidrTrie struct {
+	v4 *cidrNode
+	v6 *cidrNode
+}
+
+type cidrNode struct {
+	children [2]*cidrNode
+	name     string
+}
+
+func newCIDRTrie() *cidrTrie {
+	return &cidrTrie{v4: &cidrNode{}, v6: &cidrNode{}}
+}
+
+func (t *cidrTrie) rootFor(ip net.IP) *cidrNode {
+	if ip.To4() != nil {
+		return t.v4
+	}
+	return t.v6
+}
+
+func (t *cidrTrie) insert(cidr *net.IPNet, name string) {
+	ones, _ := cidr.Mask.Size()
+	bits := ipBits(cidr.IP)
+
+	node := t.rootFor(cidr.IP)
+	for i := 0; i < ones; i++ {
+		bit := bits[i]
+		if node.children[bit] == nil {
+			node.children[bit] = &cidrNode{}
+		}
+		node = node.children[bit]
+	}
+	node.name = name
+}
+
+func (t *cidrTrie) lookup(ip net.IP) string {
+	node := t.rootFor(ip)
+	match := node.name
+	for _, bit := range ipBits(ip) {
+		if node.children[bit] == nil {
+			break
+		}
+		node = node.children[bit]
+		if node.name != "" {
+			match = node.name
+		}
+	}
+	return match
+}
+
+func ipBits(ip net.IP) []byte {
+	addr := ip.To4()
+	if addr == nil {
+		addr = ip.To16()
+	}
+
+	bits := make([]byte, 0, len(addr)*8)
+	for _, b := range addr {
+		for i := 7; i >= 0; i-- {
+			bits = append(bits, (b>>uint(i))&1)
+		}
+	}
+	return bits
+}
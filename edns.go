@@ -0,0 +1,208 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// ednsBufSizes are the UDP payload sizes probed to map truncation thresholds.
+var ednsBufSizes = []uint16{512, 1232, 4096}
+
+// EDNSProbeResult captures what a resolver echoed back for a single EDNS(0) probe.
+type EDNSProbeResult struct {
+	Probe        string
+	BufSize      uint16
+	DO           bool
+	Truncated    bool
+	NSID         string
+	ClientCookie string
+	ServerCookie string
+	ECSAddress   string
+	ECSScope     uint8
+	RTTMs        float64
+}
+
+// EDNSLogger is implemented by query log backends that can persist EDNS
+// probe results alongside ordinary query rows.
+type EDNSLogger interface {
+	RecordEDNS(ip, domain string, results []EDNSProbeResult) error
+}
+
+// RunEDNSProbe sends the NSID, cookie, DO/bufsize, and (if ecsNet is set)
+// client-subnet probes against ip, then hands the results to logger if it
+// supports EDNS persistence.
+func RunEDNSProbe(resolver Resolver, logger QueryLogger, ip net.IP, fqdn string, ecsNet *net.IPNet) error {
+	var results []EDNSProbeResult
+
+	if r, err := probeNSID(resolver, ip, fqdn); err != nil {
+		log.Printf("EDNS NSID probe failed for %s: %v\n", ip, err)
+	} else {
+		results = append(results, *r)
+	}
+
+	if r, err := probeCookie(resolver, ip, fqdn); err != nil {
+		log.Printf("EDNS cookie probe failed for %s: %v\n", ip, err)
+	} else {
+		results = append(results, *r)
+	}
+
+	bufResults, err := probeBufSizes(resolver, ip, fqdn)
+	if err != nil {
+		log.Printf("EDNS bufsize probe failed for %s: %v\n", ip, err)
+	} else {
+		results = append(results, bufResults...)
+	}
+
+	if ecsNet != nil {
+		if r, err := probeECS(resolver, ip, fqdn, ecsNet); err != nil {
+			log.Printf("EDNS ECS probe failed for %s: %v\n", ip, err)
+		} else {
+			results = append(results, *r)
+		}
+	}
+
+	if len(results) == 0 {
+		return nil
+	}
+
+	el, ok := logger.(EDNSLogger)
+	if !ok {
+		return fmt.Errorf("configured log backend does not support EDNS option persistence")
+	}
+	return el.RecordEDNS(ip.String(), fqdn, results)
+}
+
+func probeNSID(resolver Resolver, ip net.IP, fqdn string) (*EDNSProbeResult, error) {
+	msg := &dns.Msg{}
+	msg.SetQuestion(dns.Fqdn(fqdn), dns.TypeA)
+	msg.SetEdns0(4096, false)
+	opt := msg.IsEdns0()
+	opt.Option = append(opt.Option, &dns.EDNS0_NSID{Code: dns.EDNS0NSID})
+
+	resp, rtt, _, err := resolver.Exchange(ip, msg)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &EDNSProbeResult{Probe: "nsid", RTTMs: durationMs(rtt)}
+	if respOpt := resp.IsEdns0(); respOpt != nil {
+		for _, o := range respOpt.Option {
+			if nsid, ok := o.(*dns.EDNS0_NSID); ok {
+				result.NSID = nsid.Nsid
+			}
+		}
+	}
+	return result, nil
+}
+
+func probeCookie(resolver Resolver, ip net.IP, fqdn string) (*EDNSProbeResult, error) {
+	clientCookie := make([]byte, 8)
+	if _, err := rand.Read(clientCookie); err != nil {
+		return nil, err
+	}
+
+	msg := &dns.Msg{}
+	msg.SetQuestion(dns.Fqdn(fqdn), dns.TypeA)
+	msg.SetEdns0(4096, false)
+	opt := msg.IsEdns0()
+	opt.Option = append(opt.Option, &dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: hex.EncodeToString(clientCookie)})
+
+	resp, rtt, _, err := resolver.Exchange(ip, msg)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &EDNSProbeResult{Probe: "cookie", ClientCookie: hex.EncodeToString(clientCookie), RTTMs: durationMs(rtt)}
+	if respOpt := resp.IsEdns0(); respOpt != nil {
+		for _, o := range respOpt.Option {
+			if cookie, ok := o.(*dns.EDNS0_COOKIE); ok && len(cookie.Cookie) > 16 {
+				result.ServerCookie = cookie.Cookie[16:]
+			}
+		}
+	}
+	return result, nil
+}
+
+// probeBufSizes walks the DO bit and progressive UDP buffer sizes to map
+// where a resolver starts truncating responses.
+func probeBufSizes(resolver Resolver, ip net.IP, fqdn string) ([]EDNSProbeResult, error) {
+	var results []EDNSProbeResult
+	var firstErr error
+
+	for _, size := range ednsBufSizes {
+		for _, do := range []bool{false, true} {
+			msg := &dns.Msg{}
+			msg.SetQuestion(dns.Fqdn(fqdn), dns.TypeA)
+			msg.SetEdns0(size, do)
+
+			resp, rtt, _, err := resolver.Exchange(ip, msg)
+			if err != nil {
+				if firstErr == nil {
+					firstErr = err
+				}
+				continue
+			}
+
+			results = append(results, EDNSProbeResult{
+				Probe:     fmt.Sprintf("bufsize-%d-do%t", size, do),
+				BufSize:   size,
+				DO:        do,
+				Truncated: resp.Truncated,
+				RTTMs:     durationMs(rtt),
+			})
+		}
+	}
+
+	if len(results) == 0 {
+		return nil, firstErr
+	}
+	return results, nil
+}
+
+func probeECS(resolver Resolver, ip net.IP, fqdn string, ecsNet *net.IPNet) (*EDNSProbeResult, error) {
+	msg := &dns.Msg{}
+	msg.SetQuestion(dns.Fqdn(fqdn), dns.TypeA)
+	msg.SetEdns0(4096, false)
+	opt := msg.IsEdns0()
+
+	ones, _ := ecsNet.Mask.Size()
+	family := uint16(1)
+	address := ecsNet.IP.To4()
+	if address == nil {
+		family = 2
+		address = ecsNet.IP.To16()
+	}
+
+	opt.Option = append(opt.Option, &dns.EDNS0_SUBNET{
+		Code:          dns.EDNS0SUBNET,
+		Family:        family,
+		SourceNetmask: uint8(ones),
+		Address:       address,
+	})
+
+	resp, rtt, _, err := resolver.Exchange(ip, msg)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &EDNSProbeResult{Probe: "ecs", RTTMs: durationMs(rtt)}
+	if respOpt := resp.IsEdns0(); respOpt != nil {
+		for _, o := range respOpt.Option {
+			if subnet, ok := o.(*dns.EDNS0_SUBNET); ok {
+				result.ECSAddress = subnet.Address.String()
+				result.ECSScope = subnet.SourceScope
+			}
+		}
+	}
+	return result, nil
+}
+
+func durationMs(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
@@ -10,65 +10,120 @@ import (
 	"time"
 
 	ipcipher "github.com/clwg/ip-cipher"
-	"github.com/jmoiron/sqlx"
-	_ "github.com/mattn/go-sqlite3"
 	"github.com/miekg/dns"
 )
 
 type DnsQuery struct {
-	Timestamp time.Time `db:"timestamp"`
-	Ip        string    `db:"ip"`
-	Domain    string    `db:"domain"`
-	Query     string    `db:"query"`
-	Answer    string    `db:"answer"`
+	Timestamp      time.Time `db:"timestamp" json:"timestamp"`
+	Ip             string    `db:"ip" json:"ip"`
+	Domain         string    `db:"domain" json:"domain"`
+	Query          string    `db:"query" json:"query"`
+	Qtype          string    `db:"qtype" json:"qtype"`
+	Answer         string    `db:"answer" json:"answer"`
+	Authority      string    `db:"authority" json:"authority,omitempty"`
+	Additional     string    `db:"additional" json:"additional,omitempty"`
+	Rcode          string    `db:"rcode" json:"rcode"`
+	Flags          string    `db:"flags" json:"flags,omitempty"`
+	RTTMs          float64   `db:"rtt_ms" json:"rtt_ms"`
+	ResponseSize   int       `db:"response_size" json:"response_size"`
+	Transport      string    `db:"transport" json:"transport"`
+	TLSALPN        string    `db:"tls_alpn" json:"tls_alpn,omitempty"`
+	TLSCertSHA256  string    `db:"tls_cert_sha256" json:"tls_cert_sha256,omitempty"`
+	TLSChainCN     string    `db:"tls_chain_cn" json:"tls_chain_cn,omitempty"`
+	Classification string    `db:"classification" json:"classification,omitempty"`
 }
 
-const (
-	schema = `
-	CREATE TABLE IF NOT EXISTS dns_queries (
-		timestamp TIMESTAMP,
-		ip TEXT,
-		domain TEXT,
-		query TEXT,
-		answer TEXT
-	);
-	`
-)
+// stringSliceFlag collects repeated occurrences of a flag, e.g. multiple -log values.
+type stringSliceFlag []string
+
+func (s *stringSliceFlag) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *stringSliceFlag) Set(value string) error {
+	*s = append(*s, value)
+	return nil
+}
 
 func main() {
 	domain := flag.String("domain", "", "Domain to query")
 	network := flag.String("network", "", "Network range to query")
 	timeout := flag.Int("timeout", 5, "Timeout for DNS queries in seconds")
 	domains := flag.String("domains", "", "Comma-separated list of additional domains to query")
-	dbfile := flag.String("db", "dns.db", "SQLite database file")
 	numGoroutines := flag.Int("goroutines", 20, "Number of goroutines to run simultaneously")
+	transportFlag := flag.String("transport", "udp", "DNS transport to use: udp, tcp, tls, or https")
+	port := flag.String("port", "", "Override the default port for the selected transport (53 udp/tcp, 853 tls, 443 https)")
+	qtypesFlag := flag.String("qtypes", "A", "Comma-separated record types to query per target (e.g. A,AAAA,NS,SOA,TXT,CNAME,MX,CAA,HTTPS)")
+	ednsProbe := flag.Bool("edns-probe", false, "Probe each target for EDNS(0) support: NSID, cookies, and DO/bufsize truncation thresholds")
+	ecsFlag := flag.String("ecs", "", "Client subnet (CIDR) to advertise via EDNS Client Subnet during -edns-probe")
+	sampleSize := flag.Int("sample", 0, "Instead of enumerating -network, probe this many addresses deterministically sampled from it (required for large IPv6 prefixes)")
+	seed := flag.Int64("seed", 0, "Seed for -sample's address selection, so repeat runs are reproducible")
+	hitlist := flag.String("hitlist", "", "File of newline-separated addresses to scan instead of enumerating -network")
+	qps := flag.Float64("qps", 0, "Global queries-per-second cap across all targets (0 = unlimited)")
+	qpsPer24 := flag.Float64("qps-per-24", 0, "Per-target-prefix (/24 IPv4, /48 IPv6) queries-per-second cap, halved on repeated timeouts/SERVFAIL and restored on sustained success (0 = unlimited)")
+	classifyRules := flag.String("classify-rules", "", "File of classification rules (domain <regexp> <name> / cidr <CIDR> <name>, one per line)")
+	var blocklists stringSliceFlag
+	flag.Var(&blocklists, "blocklist", "URL of a pihole-style blocklist (hosts-file or domain-per-line) to classify answers against, may be repeated")
+	var logSpecs stringSliceFlag
+	flag.Var(&logSpecs, "log", "Query log backend, may be repeated to fan out (sqlite:dns.db, jsonl:/path, syslog://host:port, stdout); defaults to sqlite:dns.db")
 	flag.Parse()
 
+	transport, err := ParseTransport(*transportFlag)
+	if err != nil {
+		log.Fatalf("Error parsing transport: %v\n", err)
+	}
+
+	qtypes, err := parseQTypes(*qtypesFlag)
+	if err != nil {
+		log.Fatalf("Error parsing qtypes: %v\n", err)
+	}
+
+	var ecsNet *net.IPNet
+	if *ecsFlag != "" {
+		_, ecsNet, err = net.ParseCIDR(*ecsFlag)
+		if err != nil {
+			log.Fatalf("Error parsing ECS CIDR: %v\n", err)
+		}
+	}
+
 	dictionary, err := ipcipher.BuildDictionary("dictionary.txt")
 	if err != nil {
 		log.Fatalf("Error building dictionary: %v\n", err)
 	}
 
-	db, err := initializeDB(*dbfile)
+	logger, err := NewQueryLogger(logSpecs)
+	if err != nil {
+		log.Fatalf("Error initializing query log: %v\n", err)
+	}
+	defer logger.Close()
+
+	resolver, err := NewResolver(transport, *port, time.Duration(*timeout)*time.Second)
 	if err != nil {
-		log.Fatalf("Error initializing database: %v\n", err)
+		log.Fatalf("Error building resolver: %v\n", err)
 	}
-	defer db.Close()
 
-	client := dns.Client{Timeout: time.Duration(*timeout) * time.Second}
+	rateLimiter := NewRateLimiter(*qps, *qpsPer24)
+	resolver = NewRateLimitedResolver(resolver, rateLimiter)
+
+	var classifier *Classifier
+	if *classifyRules != "" || len(blocklists) > 0 {
+		classifier, err = NewClassifier(*classifyRules, blocklists)
+		if err != nil {
+			log.Fatalf("Error building classifier: %v\n", err)
+		}
+	}
 
-	ip, ipnet, err := net.ParseCIDR(*network)
+	targets, err := Targets(*network, *sampleSize, *seed, *hitlist)
 	if err != nil {
-		log.Fatalf("Error parsing CIDR: %v\n", err)
+		log.Fatalf("Error building target list: %v\n", err)
 	}
 
 	semaphore := make(chan struct{}, *numGoroutines)
 
 	var wg sync.WaitGroup
 
-	for ip := ip.Mask(ipnet.Mask); ipnet.Contains(ip); inc(ip) {
-		currentIP := make(net.IP, len(ip))
-		copy(currentIP, ip)
+	for _, target := range targets {
+		currentIP := target
 
 		// Acquire a token from the semaphore
 		semaphore <- struct{}{}
@@ -76,7 +131,7 @@ func main() {
 		wg.Add(1)
 		go func(ip net.IP) {
 			defer wg.Done()
-			if err := queryDNS(ip, domain, domains, dictionary, &client, db); err != nil {
+			if err := queryDNS(ip, domain, domains, dictionary, resolver, logger, qtypes, *ednsProbe, ecsNet, classifier); err != nil {
 				log.Printf("Error querying DNS: %v\n", err)
 			}
 			// Release the token back to the semaphore
@@ -84,38 +139,42 @@ func main() {
 		}(currentIP)
 	}
 	wg.Wait()
-}
-
-func initializeDB(dbFile string) (*sqlx.DB, error) {
-	db, err := sqlx.Open("sqlite3", dbFile)
-	if err != nil {
-		return nil, err
-	}
 
-	_, err = db.Exec(schema)
-	if err != nil {
-		return nil, err
+	if stats := rateLimiter.Stats(); len(stats) > 0 {
+		if sl, ok := logger.(ScanStatsLogger); ok {
+			if err := sl.RecordScanStats(stats); err != nil {
+				log.Printf("Error recording scan stats: %v\n", err)
+			}
+		}
 	}
-
-	return db, nil
 }
 
-func queryDNS(ip net.IP, domain, domains *string, dictionary []string, client *dns.Client, db *sqlx.DB) error {
+func queryDNS(ip net.IP, domain, domains *string, dictionary []string, resolver Resolver, logger QueryLogger, qtypes []uint16, ednsProbe bool, ecsNet *net.IPNet, classifier *Classifier) error {
 	subdomain := ipcipher.EncodeIPAddress(ip, dictionary)
 	fqdn := fmt.Sprintf("%s.%s", subdomain, *domain)
 
-	query, answer, err := performDNSQuery(client, fqdn, ip)
-	if err != nil {
-		return fmt.Errorf("query request failed: %v", err)
+	if ednsProbe {
+		if err := RunEDNSProbe(resolver, logger, ip, fqdn, ecsNet); err != nil {
+			log.Printf("Error probing EDNS for %s: %v\n", ip, err)
+		}
 	}
 
-	if err := insertIntoDB(db, ip.String(), *domain, query, answer); err != nil {
-		return err
+	for _, qtype := range qtypes {
+		dnsQuery, err := performDNSQuery(resolver, fqdn, ip, qtype, classifier)
+		if err != nil {
+			log.Printf("Error querying %s %s: %v\n", fqdn, dns.TypeToString[qtype], err)
+			continue
+		}
+		dnsQuery.Domain = *domain
+
+		if err := logger.Record(dnsQuery); err != nil {
+			return err
+		}
 	}
 
 	if *domains != "" {
 		for _, additionalDomain := range strings.Split(*domains, ",") {
-			if err := queryAdditionalDNS(ip, additionalDomain, dictionary, client, db); err != nil {
+			if err := queryAdditionalDNS(ip, additionalDomain, dictionary, resolver, logger, qtypes, classifier); err != nil {
 				log.Printf("Error querying additional DNS: %v\n", err)
 			}
 		}
@@ -124,54 +183,109 @@ func queryDNS(ip net.IP, domain, domains *string, dictionary []string, client *d
 	return nil
 }
 
-func performDNSQuery(client *dns.Client, fqdn string, ip net.IP) (string, string, error) {
-	msg := dns.Msg{}
-	msg.SetQuestion(dns.Fqdn(fqdn), dns.TypeA)
+func performDNSQuery(resolver Resolver, fqdn string, ip net.IP, qtype uint16, classifier *Classifier) (DnsQuery, error) {
+	question := dns.Question{Name: dns.Fqdn(fqdn), Qtype: qtype, Qclass: dns.ClassINET}
 
-	resp, _, err := client.Exchange(&msg, net.JoinHostPort(ip.String(), "53"))
+	resp, rtt, tlsInfo, err := resolver.Query(ip, fqdn, qtype)
 	if err != nil {
-		return "", "", err
+		return DnsQuery{}, err
 	}
 
-	query := dnsQuestionToString(msg.Question[0])
-	answer := dnsRRToString(resp.Answer)
+	dnsQuery := DnsQuery{
+		Timestamp:    time.Now(),
+		Ip:           ip.String(),
+		Query:        dnsQuestionToString(question),
+		Qtype:        dns.TypeToString[qtype],
+		Answer:       dnsRRToString(resp.Answer),
+		Authority:    dnsRRToString(resp.Ns),
+		Additional:   dnsRRToString(resp.Extra),
+		Rcode:        dns.RcodeToString[resp.Rcode],
+		Flags:        dnsFlagsToString(resp.MsgHdr),
+		RTTMs:        durationMs(rtt),
+		ResponseSize: dnsMsgSize(resp),
+		Transport:    string(resolver.Transport()),
+	}
+	if tlsInfo != nil {
+		dnsQuery.TLSALPN = tlsInfo.ALPN
+		dnsQuery.TLSCertSHA256 = tlsInfo.CertSHA256
+		dnsQuery.TLSChainCN = tlsInfo.ChainCN
+	}
+	if classifier != nil {
+		dnsQuery.Classification = classifier.Classify(fqdn, resp)
+	}
 
-	return query, answer, nil
+	return dnsQuery, nil
 }
 
-func insertIntoDB(db *sqlx.DB, ip, domain, query, answer string) error {
-	stmt, err := db.Preparex("INSERT INTO dns_queries (timestamp, ip, domain, query, answer) VALUES (?, ?, ?, ?, ?)")
-	if err != nil {
-		return err
-	}
-	defer stmt.Close()
+func queryAdditionalDNS(ip net.IP, additionalDomain string, dictionary []string, resolver Resolver, logger QueryLogger, qtypes []uint16, classifier *Classifier) error {
+	for _, qtype := range qtypes {
+		dnsQuery, err := performDNSQuery(resolver, additionalDomain, ip, qtype, classifier)
+		if err != nil {
+			log.Printf("Error querying %s %s: %v\n", additionalDomain, dns.TypeToString[qtype], err)
+			continue
+		}
+		dnsQuery.Domain = additionalDomain
 
-	_, err = stmt.Exec(time.Now(), ip, domain, query, answer)
-	if err != nil {
-		return err
+		if err := logger.Record(dnsQuery); err != nil {
+			return err
+		}
 	}
 
 	return nil
 }
 
-func queryAdditionalDNS(ip net.IP, additionalDomain string, dictionary []string, client *dns.Client, db *sqlx.DB) error {
-	query, answer, err := performDNSQuery(client, additionalDomain, ip)
-	if err != nil {
-		return err
+// parseQTypes turns a comma-separated -qtypes value into the corresponding
+// miekg/dns query type constants.
+func parseQTypes(s string) ([]uint16, error) {
+	var qtypes []uint16
+	for _, name := range strings.Split(s, ",") {
+		name = strings.ToUpper(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		qtype, ok := dns.StringToType[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown record type %q", name)
+		}
+		qtypes = append(qtypes, qtype)
+	}
+	if len(qtypes) == 0 {
+		return nil, fmt.Errorf("no record types specified")
 	}
+	return qtypes, nil
+}
 
-	return insertIntoDB(db, ip.String(), additionalDomain, query, answer)
+// dnsFlagsToString renders the header bits a fingerprinting scan cares about.
+func dnsFlagsToString(hdr dns.MsgHdr) string {
+	var flags []string
+	if hdr.Authoritative {
+		flags = append(flags, "aa")
+	}
+	if hdr.Truncated {
+		flags = append(flags, "tc")
+	}
+	if hdr.RecursionDesired {
+		flags = append(flags, "rd")
+	}
+	if hdr.RecursionAvailable {
+		flags = append(flags, "ra")
+	}
+	if hdr.AuthenticatedData {
+		flags = append(flags, "ad")
+	}
+	if hdr.CheckingDisabled {
+		flags = append(flags, "cd")
+	}
+	return strings.Join(flags, ",")
 }
 
-func inc(ip net.IP) {
-	for j := len(ip) - 1; j >= 0; j-- {
-		if ip[j] < 255 {
-			ip[j]++
-			break
-		} else {
-			ip[j] = 0
-		}
+// dnsMsgSize returns the wire size of a response, recorded as response_size.
+func dnsMsgSize(msg *dns.Msg) int {
+	packed, err := msg.Pack()
+	if err != nil {
+		return 0
 	}
+	return len(packed)
 }
 
 func dnsQuestionToString(q dns.Question) string {
@@ -0,0 +1,425 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log/syslog"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// QueryLogger records completed DNS queries to a sink. Implementations must
+// be safe for concurrent use, since scans record from many goroutines.
+type QueryLogger interface {
+	Record(DnsQuery) error
+	Close() error
+}
+
+// NewQueryLogger parses one or more -log flag values (e.g. "sqlite:dns.db",
+// "jsonl:/var/log/scan.jsonl", "syslog://host:514", "stdout") and returns a
+// QueryLogger that fans each recorded query out to all of them. With no specs, it
+// defaults to the original sqlite:dns.db behavior.
+func NewQueryLogger(specs []string) (QueryLogger, error) {
+	if len(specs) == 0 {
+		specs = []string{"sqlite:dns.db"}
+	}
+
+	loggers := make([]QueryLogger, 0, len(specs))
+	for _, spec := range specs {
+		logger, err := newQueryLogger(spec)
+		if err != nil {
+			return nil, fmt.Errorf("parsing -log %q: %w", spec, err)
+		}
+		loggers = append(loggers, logger)
+	}
+
+	if len(loggers) == 1 {
+		return loggers[0], nil
+	}
+	return &fanoutLogger{loggers: loggers}, nil
+}
+
+func newQueryLogger(spec string) (QueryLogger, error) {
+	scheme, rest, ok := strings.Cut(spec, ":")
+	if !ok {
+		scheme, rest = spec, ""
+	}
+
+	switch scheme {
+	case "sqlite":
+		return newSQLiteLogger(rest)
+	case "jsonl":
+		return newJSONLLogger(rest)
+	case "syslog":
+		return newSyslogLogger(strings.TrimPrefix(rest, "//"))
+	case "stdout":
+		return newStdoutLogger(), nil
+	default:
+		return nil, fmt.Errorf("unknown log backend %q", scheme)
+	}
+}
+
+// fanoutLogger fans a single recorded query out to every configured backend.
+type fanoutLogger struct {
+	loggers []QueryLogger
+}
+
+func (f *fanoutLogger) Record(q DnsQuery) error {
+	var errs []string
+	for _, l := range f.loggers {
+		if err := l.Record(q); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("logging failed: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// RecordEDNS forwards to every configured backend that supports EDNS option
+// persistence, and fails if none of them do.
+func (f *fanoutLogger) RecordEDNS(ip, domain string, results []EDNSProbeResult) error {
+	var errs []string
+	supported := false
+	for _, l := range f.loggers {
+		el, ok := l.(EDNSLogger)
+		if !ok {
+			continue
+		}
+		supported = true
+		if err := el.RecordEDNS(ip, domain, results); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if !supported {
+		return fmt.Errorf("no configured log backend supports EDNS option persistence")
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("recording EDNS results failed: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// RecordScanStats forwards to every configured backend that supports
+// scan-stats persistence, and fails if none of them do.
+func (f *fanoutLogger) RecordScanStats(stats []PrefixStats) error {
+	var errs []string
+	supported := false
+	for _, l := range f.loggers {
+		sl, ok := l.(ScanStatsLogger)
+		if !ok {
+			continue
+		}
+		supported = true
+		if err := sl.RecordScanStats(stats); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if !supported {
+		return fmt.Errorf("no configured log backend supports scan-stats persistence")
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("recording scan stats failed: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+func (f *fanoutLogger) Close() error {
+	var errs []string
+	for _, l := range f.loggers {
+		if err := l.Close(); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("closing loggers: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+const schema = `
+CREATE TABLE IF NOT EXISTS dns_queries (
+	timestamp TIMESTAMP,
+	ip TEXT,
+	domain TEXT,
+	query TEXT,
+	qtype TEXT,
+	answer TEXT,
+	authority TEXT,
+	additional TEXT,
+	rcode TEXT,
+	flags TEXT,
+	rtt_ms REAL,
+	response_size INTEGER,
+	transport TEXT,
+	tls_alpn TEXT,
+	tls_cert_sha256 TEXT,
+	tls_chain_cn TEXT,
+	classification TEXT
+);
+
+CREATE TABLE IF NOT EXISTS edns_options (
+	timestamp TIMESTAMP,
+	ip TEXT,
+	domain TEXT,
+	probe TEXT,
+	bufsize INTEGER,
+	do BOOLEAN,
+	truncated BOOLEAN,
+	nsid TEXT,
+	client_cookie TEXT,
+	server_cookie TEXT,
+	ecs_address TEXT,
+	ecs_scope INTEGER,
+	rtt_ms REAL
+);
+
+CREATE TABLE IF NOT EXISTS scan_stats (
+	timestamp TIMESTAMP,
+	prefix TEXT,
+	effective_qps REAL,
+	backoffs INTEGER
+);
+`
+
+// sqliteLogger is the original query log backend: one row per query in a
+// local SQLite database.
+type sqliteLogger struct {
+	db *sqlx.DB
+}
+
+func newSQLiteLogger(path string) (*sqliteLogger, error) {
+	if path == "" {
+		path = "dns.db"
+	}
+
+	db, err := sqlx.Open("sqlite3", path)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := db.Exec(schema); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &sqliteLogger{db: db}, nil
+}
+
+func (l *sqliteLogger) RecordEDNS(ip, domain string, results []EDNSProbeResult) error {
+	stmt, err := l.db.Preparex(`INSERT INTO edns_options
+		(timestamp, ip, domain, probe, bufsize, do, truncated, nsid, client_cookie, server_cookie, ecs_address, ecs_scope, rtt_ms)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	now := time.Now()
+	for _, r := range results {
+		_, err := stmt.Exec(now, ip, domain, r.Probe, r.BufSize, r.DO, r.Truncated, r.NSID, r.ClientCookie, r.ServerCookie, r.ECSAddress, r.ECSScope, r.RTTMs)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (l *sqliteLogger) RecordScanStats(stats []PrefixStats) error {
+	stmt, err := l.db.Preparex(`INSERT INTO scan_stats
+		(timestamp, prefix, effective_qps, backoffs)
+		VALUES (?, ?, ?, ?)`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	now := time.Now()
+	for _, s := range stats {
+		if _, err := stmt.Exec(now, s.Prefix, s.EffectiveQPS, s.Backoffs); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (l *sqliteLogger) Record(q DnsQuery) error {
+	stmt, err := l.db.Preparex(`INSERT INTO dns_queries
+		(timestamp, ip, domain, query, qtype, answer, authority, additional, rcode, flags, rtt_ms, response_size, transport, tls_alpn, tls_cert_sha256, tls_chain_cn, classification)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	_, err = stmt.Exec(
+		q.Timestamp, q.Ip, q.Domain, q.Query, q.Qtype, q.Answer, q.Authority, q.Additional,
+		q.Rcode, q.Flags, q.RTTMs, q.ResponseSize, q.Transport, q.TLSALPN, q.TLSCertSHA256, q.TLSChainCN, q.Classification,
+	)
+	return err
+}
+
+func (l *sqliteLogger) Close() error {
+	return l.db.Close()
+}
+
+// jsonlRotateThreshold is the size at which a jsonl log file is rotated
+// aside, similar to a default logrotate size cap.
+const jsonlRotateThreshold = 50 * 1024 * 1024
+
+// jsonlLogger writes one JSON object per line, rotating the file once it
+// crosses jsonlRotateThreshold.
+type jsonlLogger struct {
+	mu      sync.Mutex
+	path    string
+	file    *os.File
+	writer  *bufio.Writer
+	written int64
+}
+
+func newJSONLLogger(path string) (*jsonlLogger, error) {
+	if path == "" {
+		return nil, fmt.Errorf("jsonl log requires a file path, e.g. jsonl:/var/log/scan.jsonl")
+	}
+
+	l := &jsonlLogger{path: path}
+	if err := l.openFile(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *jsonlLogger) openFile() error {
+	f, err := os.OpenFile(l.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	l.file = f
+	l.writer = bufio.NewWriter(f)
+	l.written = info.Size()
+	return nil
+}
+
+func (l *jsonlLogger) Record(q DnsQuery) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	line, err := json.Marshal(q)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	if l.written+int64(len(line)) > jsonlRotateThreshold {
+		if err := l.rotate(); err != nil {
+			return err
+		}
+	}
+
+	n, err := l.writer.Write(line)
+	if err != nil {
+		return err
+	}
+	l.written += int64(n)
+
+	return l.writer.Flush()
+}
+
+func (l *jsonlLogger) rotate() error {
+	if err := l.writer.Flush(); err != nil {
+		return err
+	}
+	if err := l.file.Close(); err != nil {
+		return err
+	}
+
+	rotated := l.path + "." + strconv.FormatInt(time.Now().Unix(), 10)
+	if err := os.Rename(l.path, rotated); err != nil {
+		return err
+	}
+
+	l.written = 0
+	return l.openFile()
+}
+
+func (l *jsonlLogger) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if err := l.writer.Flush(); err != nil {
+		return err
+	}
+	return l.file.Close()
+}
+
+// syslogLogger forwards each query as a single syslog message, so scans can
+// feed existing SIEM pipelines without touching SQLite.
+type syslogLogger struct {
+	writer *syslog.Writer
+}
+
+func newSyslogLogger(addr string) (*syslogLogger, error) {
+	var (
+		w   *syslog.Writer
+		err error
+	)
+	if addr == "" {
+		w, err = syslog.New(syslog.LOG_INFO|syslog.LOG_DAEMON, "dns-network-scanner")
+	} else {
+		w, err = syslog.Dial("udp", addr, syslog.LOG_INFO|syslog.LOG_DAEMON, "dns-network-scanner")
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &syslogLogger{writer: w}, nil
+}
+
+func (l *syslogLogger) Record(q DnsQuery) error {
+	return l.writer.Info(fmt.Sprintf(
+		"ip=%s domain=%s transport=%s qtype=%s rcode=%s rtt_ms=%.2f classification=%s query=%q answer=%q",
+		q.Ip, q.Domain, q.Transport, q.Qtype, q.Rcode, q.RTTMs, q.Classification, q.Query, strings.TrimSpace(q.Answer),
+	))
+}
+
+func (l *syslogLogger) Close() error {
+	return l.writer.Close()
+}
+
+// stdoutLogger prints one line per query, for quick interactive scans.
+type stdoutLogger struct {
+	mu sync.Mutex
+}
+
+func newStdoutLogger() *stdoutLogger {
+	return &stdoutLogger{}
+}
+
+func (l *stdoutLogger) Record(q DnsQuery) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	_, err := fmt.Printf(
+		"%s ip=%s domain=%s transport=%s qtype=%s rcode=%s rtt_ms=%.2f classification=%s query=%q answer=%q\n",
+		q.Timestamp.Format(time.RFC3339), q.Ip, q.Domain, q.Transport, q.Qtype, q.Rcode, q.RTTMs, q.Classification, q.Query, strings.TrimSpace(q.Answer),
+	)
+	return err
+}
+
+func (l *stdoutLogger) Close() error {
+	return nil
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"golang.org/x/time/rate"
+)
+
+const (
+	// failThreshold is the number of consecutive failures against a prefix
+	// before its effective rate is halved.
+	failThreshold = 3
+	// successThreshold is the number of consecutive successes before a
+	// backed-off prefix's rate is doubled, up to the per-prefix cap.
+	successThreshold = 5
+	// minPrefixQPS floors how far a prefix's rate can be halved.
+	minPrefixQPS = 0.1
+)
+
+// PrefixStats is a snapshot of a target prefix's rate-limiting state,
+// recorded to scan_stats at the end of a scan.
+type PrefixStats struct {
+	Prefix       string
+	EffectiveQPS float64
+	Backoffs     int
+}
+
+// ScanStatsLogger is implemented by query log backends that can persist
+// per-prefix rate-limiting stats, analogous to EDNSLogger.
+type ScanStatsLogger interface {
+	RecordScanStats([]PrefixStats) error
+}
+
+// RateLimiter throttles queries globally and per target prefix (/24 for
+// IPv4, /48 for IPv6). A prefix that repeatedly times out or returns
+// SERVFAIL has its rate halved; one that then sustains success has it
+// restored, up to the configured per-prefix cap.
+type RateLimiter struct {
+	global *rate.Limiter
+
+	perPrefixQPS float64
+	mu           sync.Mutex
+	prefixes     map[string]*prefixState
+}
+
+type prefixState struct {
+	limiter         *rate.Limiter
+	currentQPS      float64
+	consecutiveFail int
+	consecutiveOK   int
+	backoffs        int
+}
+
+// NewRateLimiter builds a limiter from the -qps and -qps-per-24 flags.
+// Either may be 0 to disable that cap.
+func NewRateLimiter(globalQPS, perPrefixQPS float64) *RateLimiter {
+	rl := &RateLimiter{perPrefixQPS: perPrefixQPS, prefixes: make(map[string]*prefixState)}
+	if globalQPS > 0 {
+		rl.global = rate.NewLimiter(rate.Limit(globalQPS), burstFor(globalQPS))
+	}
+	return rl
+}
+
+func burstFor(qps float64) int {
+	if burst := int(qps); burst > 1 {
+		return burst
+	}
+	return 1
+}
+
+// Wait blocks until ip is permitted to be queried under both the global and
+// per-prefix caps.
+func (rl *RateLimiter) Wait(ctx context.Context, ip net.IP) error {
+	if rl.global != nil {
+		if err := rl.global.Wait(ctx); err != nil {
+			return err
+		}
+	}
+	if rl.perPrefixQPS <= 0 {
+		return nil
+	}
+	return rl.prefixLimiter(ip).Wait(ctx)
+}
+
+// ReportResult feeds back whether a query against ip timed out or returned
+// SERVFAIL, driving the per-prefix backoff and recovery.
+func (rl *RateLimiter) ReportResult(ip net.IP, failed bool) {
+	if rl.perPrefixQPS <= 0 {
+		return
+	}
+
+	key := prefixKey(ip)
+
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	state, ok := rl.prefixes[key]
+	if !ok {
+		return
+	}
+
+	if failed {
+		state.consecutiveOK = 0
+		state.consecutiveFail++
+		if state.consecutiveFail >= failThreshold {
+			state.backoffs++
+			state.consecutiveFail = 0
+			state.setQPS(state.currentQPS / 2)
+		}
+		return
+	}
+
+	state.consecutiveFail = 0
+	state.consecutiveOK++
+	if state.consecutiveOK >= successThreshold && state.currentQPS < rl.perPrefixQPS {
+		state.consecutiveOK = 0
+		newQPS := state.currentQPS * 2
+		if newQPS > rl.perPrefixQPS {
+			newQPS = rl.perPrefixQPS
+		}
+		state.setQPS(newQPS)
+	}
+}
+
+func (s *prefixState) setQPS(qps float64) {
+	if qps < minPrefixQPS {
+		qps = minPrefixQPS
+	}
+	s.currentQPS = qps
+	s.limiter.SetLimit(rate.Limit(qps))
+	s.limiter.SetBurst(burstFor(qps))
+}
+
+func (rl *RateLimiter) prefixLimiter(ip net.IP) *rate.Limiter {
+	key := prefixKey(ip)
+
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	state, ok := rl.prefixes[key]
+	if !ok {
+		state = &prefixState{
+			limiter:    rate.NewLimiter(rate.Limit(rl.perPrefixQPS), burstFor(rl.perPrefixQPS)),
+			currentQPS: rl.perPrefixQPS,
+		}
+		rl.prefixes[key] = state
+	}
+	return state.limiter
+}
+
+// Stats returns a snapshot of every prefix seen so far, for the scan_stats table.
+func (rl *RateLimiter) Stats() []PrefixStats {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	stats := make([]PrefixStats, 0, len(rl.prefixes))
+	for prefix, state := range rl.prefixes {
+		stats = append(stats, PrefixStats{Prefix: prefix, EffectiveQPS: state.currentQPS, Backoffs: state.backoffs})
+	}
+	return stats
+}
+
+func prefixKey(ip net.IP) string {
+	if v4 := ip.To4(); v4 != nil {
+		mask := net.CIDRMask(24, 32)
+		return (&net.IPNet{IP: v4.Mask(mask), Mask: mask}).String()
+	}
+	mask := net.CIDRMask(48, 128)
+	return (&net.IPNet{IP: ip.To16().Mask(mask), Mask: mask}).String()
+}
+
+// rateLimitedResolver wraps a Resolver with the global/per-prefix caps and
+// feeds query outcomes back into the limiter's backoff logic.
+type rateLimitedResolver struct {
+	Resolver
+	limiter *RateLimiter
+}
+
+// NewRateLimitedResolver wraps r so every query is throttled by limiter.
+func NewRateLimitedResolver(r Resolver, limiter *RateLimiter) Resolver {
+	return &rateLimitedResolver{Resolver: r, limiter: limiter}
+}
+
+func (r *rateLimitedResolver) Query(ip net.IP, fqdn string, qtype uint16) (*dns.Msg, time.Duration, *TLSInfo, error) {
+	if err := r.limiter.Wait(context.Background(), ip); err != nil {
+		return nil, 0, nil, err
+	}
+	resp, rtt, tlsInfo, err := r.Resolver.Query(ip, fqdn, qtype)
+	r.limiter.ReportResult(ip, isRetryableFailure(resp, err))
+	return resp, rtt, tlsInfo, err
+}
+
+func (r *rateLimitedResolver) Exchange(ip net.IP, msg *dns.Msg) (*dns.Msg, time.Duration, *TLSInfo, error) {
+	if err := r.limiter.Wait(context.Background(), ip); err != nil {
+		return nil, 0, nil, err
+	}
+	resp, rtt, tlsInfo, err := r.Resolver.Exchange(ip, msg)
+	r.limiter.ReportResult(ip, isRetryableFailure(resp, err))
+	return resp, rtt, tlsInfo, err
+}
+
+func isRetryableFailure(resp *dns.Msg, err error) bool {
+	if err != nil {
+		return true
+	}
+	return resp != nil && resp.Rcode == dns.RcodeServerFailure
+}
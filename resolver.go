@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Transport identifies the protocol used to reach a resolver.
+type Transport string
+
+const (
+	TransportUDP   Transport = "udp"
+	TransportTCP   Transport = "tcp"
+	TransportTLS   Transport = "tls"
+	TransportHTTPS Transport = "https"
+)
+
+// ParseTransport validates a -transport flag value.
+func ParseTransport(s string) (Transport, error) {
+	switch t := Transport(s); t {
+	case TransportUDP, TransportTCP, TransportTLS, TransportHTTPS:
+		return t, nil
+	default:
+		return "", fmt.Errorf("unknown transport %q (want udp, tcp, tls, or https)", s)
+	}
+}
+
+// defaultPort returns the conventional port for a transport.
+func defaultPort(t Transport) string {
+	switch t {
+	case TransportTLS:
+		return "853"
+	case TransportHTTPS:
+		return "443"
+	default:
+		return "53"
+	}
+}
+
+// TLSInfo captures TLS handshake details observed against a resolver. It is
+// only populated for the tls and https transports.
+type TLSInfo struct {
+	ALPN       string
+	CertSHA256 string
+	ChainCN    string
+}
+
+// Resolver performs DNS queries against a target IP over a specific transport.
+type Resolver interface {
+	// Query builds and sends a simple question for fqdn/qtype.
+	Query(ip net.IP, fqdn string, qtype uint16) (resp *dns.Msg, rtt time.Duration, tlsInfo *TLSInfo, err error)
+	// Exchange sends a caller-constructed message, letting probes attach
+	// custom EDNS0 options that Query's plain question can't express.
+	Exchange(ip net.IP, msg *dns.Msg) (resp *dns.Msg, rtt time.Duration, tlsInfo *TLSInfo, err error)
+	Transport() Transport
+}
+
+// NewResolver builds the Resolver for the requested transport, defaulting the
+// port to the transport's conventional one when port is empty.
+func NewResolver(transport Transport, port string, timeout time.Duration) (Resolver, error) {
+	if port == "" {
+		port = defaultPort(transport)
+	}
+
+	switch transport {
+	case TransportUDP:
+		return &dnsClientResolver{client: &dns.Client{Net: "udp", Timeout: timeout}, port: port, transport: TransportUDP}, nil
+	case TransportTCP:
+		return &dnsClientResolver{client: &dns.Client{Net: "tcp", Timeout: timeout}, port: port, transport: TransportTCP}, nil
+	case TransportTLS:
+		return &dnsClientResolver{
+			client:     &dns.Client{Net: "tcp-tls", Timeout: timeout, TLSConfig: &tls.Config{InsecureSkipVerify: true}},
+			port:       port,
+			captureTLS: true,
+			transport:  TransportTLS,
+		}, nil
+	case TransportHTTPS:
+		return &dohResolver{
+			httpClient: &http.Client{
+				Timeout:   timeout,
+				Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}},
+			},
+			port: port,
+		}, nil
+	default:
+		return nil, fmt.Errorf("unsupported transport: %s", transport)
+	}
+}
+
+// dnsClientResolver handles the udp, tcp, and tls transports using
+// miekg/dns, which length-prefixes messages on tcp and tls. Each query dials
+// its own connection and closes it afterwards; connections are not pooled
+// or reused across queries.
+type dnsClientResolver struct {
+	client     *dns.Client
+	port       string
+	captureTLS bool
+	transport  Transport
+}
+
+func (r *dnsClientResolver) Transport() Transport { return r.transport }
+
+func (r *dnsClientResolver) Query(ip net.IP, fqdn string, qtype uint16) (*dns.Msg, time.Duration, *TLSInfo, error) {
+	msg := &dns.Msg{}
+	msg.SetQuestion(dns.Fqdn(fqdn), qtype)
+	return r.Exchange(ip, msg)
+}
+
+func (r *dnsClientResolver) Exchange(ip net.IP, msg *dns.Msg) (*dns.Msg, time.Duration, *TLSInfo, error) {
+	addr := net.JoinHostPort(ip.String(), r.port)
+
+	conn, err := r.client.Dial(addr)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	defer conn.Close()
+
+	var tlsInfo *TLSInfo
+	if r.captureTLS {
+		if tlsConn, ok := conn.Conn.(*tls.Conn); ok {
+			tlsInfo = tlsConnInfo(tlsConn.ConnectionState())
+		}
+	}
+
+	resp, rtt, err := r.client.ExchangeWithConn(msg, conn)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+
+	return resp, rtt, tlsInfo, nil
+}
+
+// dohResolver implements DNS-over-HTTPS per RFC 8484 using the
+// application/dns-message POST form.
+type dohResolver struct {
+	httpClient *http.Client
+	port       string
+}
+
+func (r *dohResolver) Transport() Transport { return TransportHTTPS }
+
+func (r *dohResolver) Query(ip net.IP, fqdn string, qtype uint16) (*dns.Msg, time.Duration, *TLSInfo, error) {
+	msg := &dns.Msg{}
+	msg.SetQuestion(dns.Fqdn(fqdn), qtype)
+	return r.Exchange(ip, msg)
+}
+
+func (r *dohResolver) Exchange(ip net.IP, msg *dns.Msg) (*dns.Msg, time.Duration, *TLSInfo, error) {
+	packed, err := msg.Pack()
+	if err != nil {
+		return nil, 0, nil, err
+	}
+
+	url := fmt.Sprintf("https://%s/dns-query", net.JoinHostPort(ip.String(), r.port))
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(packed))
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+
+	start := time.Now()
+	resp, err := r.httpClient.Do(req)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, 0, nil, fmt.Errorf("doh query failed: status %s", resp.Status)
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	rtt := time.Since(start)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+
+	reply := &dns.Msg{}
+	if err := reply.Unpack(body); err != nil {
+		return nil, 0, nil, err
+	}
+
+	var tlsInfo *TLSInfo
+	if resp.TLS != nil {
+		tlsInfo = tlsConnInfo(*resp.TLS)
+	}
+
+	return reply, rtt, tlsInfo, nil
+}
+
+func tlsConnInfo(state tls.ConnectionState) *TLSInfo {
+	info := &TLSInfo{ALPN: state.NegotiatedProtocol}
+	if len(state.PeerCertificates) > 0 {
+		cert := state.PeerCertificates[0]
+		sum := sha256.Sum256(cert.Raw)
+		info.CertSHA256 = hex.EncodeToString(sum[:])
+		info.ChainCN = cert.Subject.CommonName
+	}
+	return info
+}
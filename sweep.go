@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"math/big"
+	"math/bits"
+	"net"
+	"os"
+	"strings"
+)
+
+// reservedNets are skipped when sampling, since they're never useful scan
+// targets: documentation ranges, link-local, and multicast.
+var reservedNets = mustParseCIDRs(
+	"192.0.2.0/24",
+	"198.51.100.0/24",
+	"203.0.113.0/24",
+	"169.254.0.0/16",
+	"224.0.0.0/4",
+	"2001:db8::/32",
+	"fe80::/10",
+	"ff00::/8",
+)
+
+func mustParseCIDRs(cidrs ...string) []*net.IPNet {
+	nets := make([]*net.IPNet, len(cidrs))
+	for i, c := range cidrs {
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			panic(err)
+		}
+		nets[i] = n
+	}
+	return nets
+}
+
+func isReserved(ip net.IP) bool {
+	for _, n := range reservedNets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Targets builds the list of addresses a scan should probe: a hitlist file
+// when given, N deterministically sampled addresses from network when
+// sampleSize > 0, or every address in network in order otherwise. Full
+// enumeration of an IPv6 prefix with more than 32 host bits is rejected,
+// since it currently only makes sense for small ranges.
+func Targets(network string, sampleSize int, seed int64, hitlistPath string) ([]net.IP, error) {
+	if hitlistPath != "" {
+		return readHitlist(hitlistPath)
+	}
+
+	if network == "" {
+		return nil, fmt.Errorf("either -network or -hitlist is required")
+	}
+
+	ip, ipnet, err := net.ParseCIDR(network)
+	if err != nil {
+		return nil, err
+	}
+
+	if sampleSize > 0 {
+		return sampleCIDR(ipnet, sampleSize, seed), nil
+	}
+
+	ones, bits := ipnet.Mask.Size()
+	if ip.To4() == nil && bits-ones > 32 {
+		return nil, fmt.Errorf("%s has %d host bits; use -sample or -hitlist instead of full enumeration", network, bits-ones)
+	}
+
+	return enumerateCIDR(ipnet), nil
+}
+
+func enumerateCIDR(ipnet *net.IPNet) []net.IP {
+	var addrs []net.IP
+	for ip := cloneIP(ipnet.IP.Mask(ipnet.Mask)); ipnet.Contains(ip); inc(ip) {
+		addrs = append(addrs, cloneIP(ip))
+	}
+	return addrs
+}
+
+// sampleCIDR deterministically picks n addresses from ipnet by hashing the
+// index i=0..n-1 with siphash keyed on seed, masking the result to the
+// prefix's host bits, and OR-ing it into the network address. Reserved and
+// already-picked addresses are skipped and replaced by sampling further along
+// the sequence. Sampling stops after n*1000 draws, so a prefix with fewer
+// than n usable addresses yields fewer than n.
+func sampleCIDR(ipnet *net.IPNet, n int, seed int64) []net.IP {
+	ones, totalBits := ipnet.Mask.Size()
+	hostBits := totalBits - ones
+	base := cloneIP(ipnet.IP.Mask(ipnet.Mask))
+
+	addrs := make([]net.IP, 0, n)
+	seen := make(map[string]bool, n)
+
+	for i := uint64(0); len(addrs) < n && i < uint64(n)*1000; i++ {
+		offset := sipHashOffset(seed, i, hostBits)
+		addr := orOffset(base, offset)
+
+		if isReserved(addr) || seen[addr.String()] {
+			continue
+		}
+		seen[addr.String()] = true
+		addrs = append(addrs, addr)
+	}
+
+	return addrs
+}
+
+// orOffset returns a copy of base with offset OR-ed into its low bits.
+// offset.Bytes() is big-endian and at most len(addr) long (sipHashOffset
+// masks it to hostBits), so it's aligned against the tail of addr.
+func orOffset(base net.IP, offset *big.Int) net.IP {
+	addr := cloneIP(base)
+	offBytes := offset.Bytes()
+	for i, b := range offBytes {
+		addr[len(addr)-len(offBytes)+i] |= b
+	}
+	return addr
+}
+
+func readHitlist(path string) ([]net.IP, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var addrs []net.IP
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		ip := net.ParseIP(line)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid address %q in hitlist", line)
+		}
+		addrs = append(addrs, ip)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return addrs, nil
+}
+
+func cloneIP(ip net.IP) net.IP {
+	out := make(net.IP, len(ip))
+	copy(out, ip)
+	return out
+}
+
+func inc(ip net.IP) {
+	for j := len(ip) - 1; j >= 0; j-- {
+		if ip[j] < 255 {
+			ip[j]++
+			break
+		} else {
+			ip[j] = 0
+		}
+	}
+}
+
+// sipHashOffset returns a reproducible pseudo-random offset in [0, 2^hostBits)
+// by hashing i against as many independent 64-bit blocks as needed to cover
+// hostBits, concatenating them into a single big.Int, and masking down to
+// the exact width. A plain uint64 only varies the low 64 bits, which leaves
+// the rest of any prefix wider than /64 untouched; hashing multiple blocks
+// spreads samples across the whole host portion.
+func sipHashOffset(seed int64, i uint64, hostBits int) *big.Int {
+	if hostBits <= 0 {
+		return new(big.Int)
+	}
+
+	blocks := (hostBits + 63) / 64
+	offset := new(big.Int)
+	for b := 0; b < blocks; b++ {
+		var msg [16]byte
+		binary.LittleEndian.PutUint64(msg[0:8], i)
+		binary.LittleEndian.PutUint64(msg[8:16], uint64(b))
+
+		h := sipHash(uint64(seed), uint64(seed)^0x646f72616e646f6d, msg[:])
+
+		offset.Lsh(offset, 64)
+		offset.Or(offset, new(big.Int).SetUint64(h))
+	}
+
+	mask := new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), uint(hostBits)), big.NewInt(1))
+	return offset.And(offset, mask)
+}
+
+// sipHash implements SipHash-2-4 (Aumasson & Bernstein, 2012).
+func sipHash(k0, k1 uint64, p []byte) uint64 {
+	v0 := k0 ^ 0x736f6d6570736575
+	v1 := k1 ^ 0x646f72616e646f6d
+	v2 := k0 ^ 0x6c7967656e657261
+	v3 := k1 ^ 0x7465646279746573
+
+	n := len(p)
+	end := n - n%8
+	for i := 0; i < end; i += 8 {
+		m := binary.LittleEndian.Uint64(p[i : i+8])
+		v3 ^= m
+		v0, v1, v2, v3 = sipRound(v0, v1, v2, v3)
+		v0, v1, v2, v3 = sipRound(v0, v1, v2, v3)
+		v0 ^= m
+	}
+
+	var last [8]byte
+	copy(last[:], p[end:])
+	last[7] = byte(n)
+	m := binary.LittleEndian.Uint64(last[:])
+	v3 ^= m
+	v0, v1, v2, v3 = sipRound(v0, v1, v2, v3)
+	v0, v1, v2, v3 = sipRound(v0, v1, v2, v3)
+	v0 ^= m
+
+	v2 ^= 0xff
+	v0, v1, v2, v3 = sipRound(v0, v1, v2, v3)
+	v0, v1, v2, v3 = sipRound(v0, v1, v2, v3)
+	v0, v1, v2, v3 = sipRound(v0, v1, v2, v3)
+	v0, v1, v2, v3 = sipRound(v0, v1, v2, v3)
+
+	return v0 ^ v1 ^ v2 ^ v3
+}
+
+func sipRound(v0, v1, v2, v3 uint64) (uint64, uint64, uint64, uint64) {
+	v0 += v1
+	v1 = bits.RotateLeft64(v1, 13)
+	v1 ^= v0
+	v0 = bits.RotateLeft64(v0, 32)
+	v2 += v3
+	v3 = bits.RotateLeft64(v3, 16)
+	v3 ^= v2
+	v0 += v3
+	v3 = bits.RotateLeft64(v3, 21)
+	v3 ^= v0
+	v2 += v1
+	v1 = bits.RotateLeft64(v1, 17)
+	v1 ^= v2
+	v2 = bits.RotateLeft64(v2, 32)
+	return v0, v1, v2, v3
+}